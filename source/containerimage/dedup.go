@@ -0,0 +1,41 @@
+package containerimage
+
+import (
+	"encoding/json"
+
+	digest "github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/identity"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// chainIDsForConfig is not wired into CacheKey: letting
+// CacheAccessor.GetByBlob reuse a layer already unpacked from a different
+// compression variant of the same diff_id (e.g. skip re-pulling when a
+// manifest switches a layer from gzip to zstd) needs cache.DescHandler and
+// GetByBlob, in the cache package, to grow a ChainID hint they can look refs
+// up by, and to accept one via solver.CacheOpts, which GetByBlob does not
+// currently read at all. The cache package isn't part of this checkout, so
+// that wiring isn't implemented here; chainIDsForConfig is left as a
+// standalone, unconsumed utility for whoever adds it.
+
+// chainIDsForConfig walks img config dt's RootFS.DiffIDs and, assuming
+// descriptors is in the same base-to-top order (true for
+// PulledManifests.Remote.Descriptors), returns the chainID each descriptor's
+// layer resolves to, keyed by the descriptor's own digest. It returns a nil
+// map, without error, if dt isn't a layers-based OCI config or its DiffIDs
+// don't line up with descriptors.
+func chainIDsForConfig(dt []byte, descriptors []specs.Descriptor) (map[digest.Digest]digest.Digest, error) {
+	var img specs.Image
+	if err := json.Unmarshal(dt, &img); err != nil {
+		return nil, err
+	}
+	if img.RootFS.Type != "layers" || len(img.RootFS.DiffIDs) != len(descriptors) {
+		return nil, nil
+	}
+
+	chainIDs := make(map[digest.Digest]digest.Digest, len(descriptors))
+	for i, desc := range descriptors {
+		chainIDs[desc.Digest] = identity.ChainID(img.RootFS.DiffIDs[:i+1])
+	}
+	return chainIDs, nil
+}
@@ -0,0 +1,200 @@
+package containerimage
+
+import (
+	"context"
+	"sync"
+
+	"github.com/containerd/containerd/content"
+	digest "github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/sync/semaphore"
+)
+
+// LayerDownloadManager coordinates concurrent layer blob fetches across
+// builds so that two builds referencing the same base image share a single
+// in-flight download instead of each triggering its own. It plays the role
+// for containerimage pulls that moby's distribution/xfer transfer manager
+// plays for the classic builder.
+//
+// A single LayerDownloadManager is meant to be shared across all pulls
+// handled by a worker (wired in through SourceOpt), not created per build,
+// since the point is to bound parallelism and dedupe fetches globally.
+type LayerDownloadManager struct {
+	maxDownloads int
+	maxUploads   int
+	downloads    *semaphore.Weighted
+	uploads      *semaphore.Weighted
+
+	mu       sync.Mutex
+	inFlight map[digest.Digest]*pendingFetch
+}
+
+type pendingFetch struct {
+	done chan struct{}
+	ra   content.ReaderAt
+	err  error
+
+	// refs counts the readerAt handles handed out for this fetch that
+	// haven't been Closed yet, guarded by manager.mu. The underlying ra is
+	// only closed, and the downloads semaphore slot only released, once it
+	// drops to zero, so coalesced callers can each Close their own handle
+	// without double-closing ra or releasing the slot before every caller
+	// is done reading.
+	refs int
+}
+
+// NewLayerDownloadManager returns a manager that admits at most
+// maxConcurrentDownloads concurrent blob reads across every caller sharing
+// it. The manager wraps no write path: maxConcurrentUploads only sizes the
+// upload slots that Pause takes and Resume returns, and no blob write waits
+// on them. A value <= 0 means unbounded for that direction.
+func NewLayerDownloadManager(maxConcurrentDownloads, maxConcurrentUploads int) *LayerDownloadManager {
+	m := &LayerDownloadManager{
+		maxDownloads: maxConcurrentDownloads,
+		maxUploads:   maxConcurrentUploads,
+		inFlight:     make(map[digest.Digest]*pendingFetch),
+	}
+	if maxConcurrentDownloads > 0 {
+		m.downloads = semaphore.NewWeighted(int64(maxConcurrentDownloads))
+	}
+	if maxConcurrentUploads > 0 {
+		m.uploads = semaphore.NewWeighted(int64(maxConcurrentUploads))
+	}
+	return m
+}
+
+// Provider wraps base so that concurrent ReaderAt calls for the same
+// digest -- whether from this build or a different one sharing this
+// manager -- are coalesced into a single underlying fetch, and so the
+// manager's max-concurrent-downloads limit applies across all of them.
+// puller.CacheKey wraps p.manifest.Remote.Provider with this before handing
+// it to cache.DescHandler, so CacheAccessor.GetByBlob benefits transparently.
+func (m *LayerDownloadManager) Provider(base content.Provider) content.Provider {
+	return &managedProvider{Provider: base, manager: m}
+}
+
+type managedProvider struct {
+	content.Provider
+	manager *LayerDownloadManager
+}
+
+func (p *managedProvider) ReaderAt(ctx context.Context, desc specs.Descriptor) (content.ReaderAt, error) {
+	return p.manager.readerAt(ctx, p.Provider, desc)
+}
+
+func (m *LayerDownloadManager) readerAt(ctx context.Context, base content.Provider, desc specs.Descriptor) (content.ReaderAt, error) {
+	m.mu.Lock()
+	if f, ok := m.inFlight[desc.Digest]; ok {
+		f.refs++
+		m.mu.Unlock()
+		<-f.done
+		if f.err != nil {
+			return nil, f.err
+		}
+		return &refCountedReaderAt{fetch: f, manager: m, digest: desc.Digest}, nil
+	}
+	f := &pendingFetch{done: make(chan struct{}), refs: 1}
+	m.inFlight[desc.Digest] = f
+	m.mu.Unlock()
+
+	// Held until every refCountedReaderAt handed out for this fetch is
+	// Closed (see release), not just until the transfer starts, so
+	// maxConcurrentDownloads bounds concurrent transfers and Pause can
+	// actually drain them.
+	var acquired bool
+	if m.downloads != nil {
+		if err := m.downloads.Acquire(ctx, 1); err != nil {
+			f.err = err
+		} else {
+			acquired = true
+		}
+	}
+	if f.err == nil {
+		f.ra, f.err = base.ReaderAt(ctx, desc)
+	}
+	close(f.done)
+	if f.err != nil {
+		m.mu.Lock()
+		delete(m.inFlight, desc.Digest)
+		m.mu.Unlock()
+		if acquired {
+			m.downloads.Release(1)
+		}
+		return nil, f.err
+	}
+	return &refCountedReaderAt{fetch: f, manager: m, digest: desc.Digest}, nil
+}
+
+// release drops one reference to f, the fetch for digest, and once every
+// handle handed out for it has been Closed, removes it from inFlight, closes
+// the real content.ReaderAt, and releases the download slot it holds.
+func (m *LayerDownloadManager) release(f *pendingFetch, dgst digest.Digest) error {
+	m.mu.Lock()
+	f.refs--
+	last := f.refs <= 0
+	if last {
+		delete(m.inFlight, dgst)
+	}
+	m.mu.Unlock()
+	if !last {
+		return nil
+	}
+	err := f.ra.Close()
+	if m.downloads != nil {
+		m.downloads.Release(1)
+	}
+	return err
+}
+
+// refCountedReaderAt is handed to each caller coalesced onto the same fetch,
+// so GetByBlob closing the handle it received doesn't close the shared
+// content.ReaderAt (or release its download slot) out from under any other
+// caller still reading it.
+type refCountedReaderAt struct {
+	fetch   *pendingFetch
+	manager *LayerDownloadManager
+	digest  digest.Digest
+}
+
+func (r *refCountedReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	return r.fetch.ra.ReadAt(p, off)
+}
+
+func (r *refCountedReaderAt) Size() int64 {
+	return r.fetch.ra.Size()
+}
+
+func (r *refCountedReaderAt) Close() error {
+	return r.manager.release(r.fetch, r.digest)
+}
+
+// Pause blocks new downloads and uploads from starting, without cancelling
+// transfers already in flight; it returns once all of them have drained.
+// Resume reverses it. Snapshot can use this to bound parallelism across
+// builds that share a manager instead of per build.
+func (m *LayerDownloadManager) Pause(ctx context.Context) error {
+	if m.downloads != nil {
+		if err := m.downloads.Acquire(ctx, int64(m.maxDownloads)); err != nil {
+			return err
+		}
+	}
+	if m.uploads != nil {
+		if err := m.uploads.Acquire(ctx, int64(m.maxUploads)); err != nil {
+			if m.downloads != nil {
+				m.downloads.Release(int64(m.maxDownloads))
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// Resume reverses a prior successful Pause.
+func (m *LayerDownloadManager) Resume() {
+	if m.downloads != nil {
+		m.downloads.Release(int64(m.maxDownloads))
+	}
+	if m.uploads != nil {
+		m.uploads.Release(int64(m.maxUploads))
+	}
+}
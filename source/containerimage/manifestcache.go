@@ -0,0 +1,179 @@
+package containerimage
+
+import (
+	"bytes"
+	"context"
+	"time"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/leases"
+	digest "github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// manifestCacheTagTTL bounds how long a ref -> digest mapping is trusted for
+// ResolveModeDefault; it mirrors how short-lived tags (":latest") can move
+// without forcing every resolve to hit the registry. ResolveModePreferLocal
+// pins the mapping indefinitely instead, and ResolveModeForcePull skips the
+// cached lookup (the freshly resolved digest is still recorded).
+const manifestCacheTagTTL = 10 * time.Minute
+
+// manifestCache persists resolved manifests, manifest lists, and image
+// configs in the containerd content store, indexed both by their own digest
+// (so a blob can be read back without a registry round-trip) and by the ref
+// they were resolved from (so a plain tag can be mapped back to a digest
+// without re-resolving). It backs Source.ResolveImageConfig, and the manifest
+// list/manifest/config blobs pinned from puller.CacheKey, so that repeated
+// resolves of the same base image, common across multi-stage builds, don't
+// re-fetch from the registry every time the in-process flightcontrol.Group
+// result has already been evicted.
+//
+// Entries are kept alive via leases rather than content labels directly, the
+// same mechanism puller.Snapshot already uses to pin layer blobs to a ref's
+// lifetime (see the Nonlayers loop in Snapshot), so an external GC sweep
+// (SourceOpt.GarbageCollect) naturally respects them.
+type manifestCache struct {
+	store content.Store
+	lm    leases.Manager
+}
+
+func newManifestCache(store content.Store, lm leases.Manager) *manifestCache {
+	return &manifestCache{store: store, lm: lm}
+}
+
+// tagLeaseID derives a stable lease ID for the ref -> manifest digest
+// mapping of key (as built by ResolveImageConfig: ref optionally suffixed
+// with the platform).
+func tagLeaseID(key string) string {
+	return "containerimage-tag-" + digest.FromString(key).String()
+}
+
+// configLeaseID derives a stable lease ID for the manifest digest -> config
+// digest mapping of a resolved manifest.
+func configLeaseID(manifestDigest digest.Digest) string {
+	return "containerimage-config-of-" + manifestDigest.String()
+}
+
+// digestLeaseID derives a stable lease ID that pins a single blob (manifest
+// list, manifest, or config) by its own digest, independent of any ref's
+// TTL, so it survives as long as any ref still maps to it.
+func digestLeaseID(dgst digest.Digest) string {
+	return "containerimage-blob-" + dgst.String()
+}
+
+// lookupResource returns the content-typed resource digest recorded against
+// leaseID, if any.
+func (c *manifestCache) lookupResource(ctx context.Context, leaseID string) (digest.Digest, bool) {
+	resources, err := c.lm.ListResources(ctx, leases.Lease{ID: leaseID})
+	if err != nil {
+		return "", false
+	}
+	for _, r := range resources {
+		if r.Type == "content" {
+			return digest.Digest(r.ID), true
+		}
+	}
+	return "", false
+}
+
+// linkResource records dgst as the content-typed resource of leaseID,
+// creating the lease if it doesn't already exist.
+func (c *manifestCache) linkResource(ctx context.Context, leaseID string, dgst digest.Digest, opts ...leases.Opt) error {
+	l, err := c.lm.Create(ctx, append([]leases.Opt{leases.WithID(leaseID)}, opts...)...)
+	if err != nil {
+		if !errdefs.IsAlreadyExists(err) {
+			return err
+		}
+		l = leases.Lease{ID: leaseID}
+	}
+	return c.lm.AddResource(ctx, l, leases.Resource{ID: dgst.String(), Type: "content"})
+}
+
+// get looks up the manifest digest key last resolved to. It returns false if
+// there is no cached mapping, or the mapping has expired.
+func (c *manifestCache) get(ctx context.Context, key string) (digest.Digest, bool) {
+	id := tagLeaseID(key)
+	ls, err := c.lm.List(ctx, `id=="`+id+`"`)
+	if err != nil || len(ls) == 0 {
+		return "", false
+	}
+	if exp, ok := ls[0].Labels["containerd.io/gc.expire"]; ok {
+		if t, err := time.Parse(time.RFC3339, exp); err == nil && time.Now().After(t) {
+			return "", false
+		}
+	}
+	return c.lookupResource(ctx, id)
+}
+
+// put records that key currently resolves to manifestDigest. When persist is
+// true (ResolveModePreferLocal) the mapping is kept indefinitely; otherwise
+// it expires after manifestCacheTagTTL so a moved tag is eventually
+// re-resolved.
+func (c *manifestCache) put(ctx context.Context, key string, manifestDigest digest.Digest, persist bool) error {
+	id := tagLeaseID(key)
+	if err := c.lm.Delete(ctx, leases.Lease{ID: id}); err != nil && !errdefs.IsNotFound(err) {
+		return err
+	}
+	var opts []leases.Opt
+	if !persist {
+		opts = append(opts, leases.WithExpiration(manifestCacheTagTTL))
+	}
+	return c.linkResource(ctx, id, manifestDigest, opts...)
+}
+
+// getConfigDigest looks up the config digest previously linked to
+// manifestDigest via putConfigDigest.
+func (c *manifestCache) getConfigDigest(ctx context.Context, manifestDigest digest.Digest) (digest.Digest, bool) {
+	return c.lookupResource(ctx, configLeaseID(manifestDigest))
+}
+
+// putConfigDigest records that manifestDigest's image config is stored under
+// configDigest.
+func (c *manifestCache) putConfigDigest(ctx context.Context, manifestDigest, configDigest digest.Digest) error {
+	return c.linkResource(ctx, configLeaseID(manifestDigest), configDigest)
+}
+
+// pin keeps a blob that's already present in the content store (e.g. a
+// manifest list or manifest written there by PullManifests) alive
+// independent of any ref's TTL, without rewriting its content.
+func (c *manifestCache) pin(ctx context.Context, dgst digest.Digest) error {
+	id := digestLeaseID(dgst)
+	l, err := c.lm.Create(ctx, leases.WithID(id))
+	if err != nil {
+		if !errdefs.IsAlreadyExists(err) {
+			return err
+		}
+		l = leases.Lease{ID: id}
+	}
+	return c.lm.AddResource(ctx, l, leases.Resource{ID: dgst.String(), Type: "content"})
+}
+
+// writeBlob writes dt to the content store under its own digest
+// (digest.FromBytes(dt), returned as dgst) and pins it. Callers that already
+// know dt's digest from elsewhere (e.g. a descriptor) should verify it
+// matches before relying on the return value.
+func (c *manifestCache) writeBlob(ctx context.Context, dt []byte, mediaType string) (digest.Digest, error) {
+	dgst := digest.FromBytes(dt)
+	desc := specs.Descriptor{
+		Digest:    dgst,
+		Size:      int64(len(dt)),
+		MediaType: mediaType,
+	}
+	if err := content.WriteBlob(ctx, c.store, dgst.String(), bytes.NewReader(dt), desc); err != nil && !errdefs.IsAlreadyExists(err) {
+		return "", err
+	}
+	if err := c.pin(ctx, dgst); err != nil {
+		return "", err
+	}
+	return dgst, nil
+}
+
+// load reads back a blob previously written by writeBlob or pin.
+func (c *manifestCache) load(ctx context.Context, dgst digest.Digest) ([]byte, error) {
+	info, err := c.store.Info(ctx, dgst)
+	if err != nil {
+		return nil, err
+	}
+	return content.ReadBlob(ctx, c.store, specs.Descriptor{Digest: dgst, Size: info.Size})
+}
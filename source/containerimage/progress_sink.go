@@ -0,0 +1,58 @@
+package containerimage
+
+import (
+	digest "github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// PullPhase identifies where a descriptor is in the pull pipeline, mirroring
+// the phases docker's classic distribution puller reports for `docker pull`
+// output.
+type PullPhase string
+
+const (
+	PullPhaseWaiting     PullPhase = "waiting"
+	PullPhaseDownloading PullPhase = "downloading"
+	PullPhaseExtracting  PullPhase = "extracting"
+	PullPhaseVerifying   PullPhase = "verifying"
+	PullPhaseComplete    PullPhase = "complete"
+	PullPhaseExists      PullPhase = "exists"
+)
+
+// PullProgressEvent reports progress for a single descriptor (manifest,
+// config, or layer) during a pull. It's a first-class, structured
+// alternative to scraping vertex names out of the progress.Writer attached
+// via progress.FromContext, for consumers (e.g. dockerd's pkgprogress)
+// that want to render docker-style per-layer pull output.
+type PullProgressEvent struct {
+	Digest    digest.Digest
+	MediaType string
+	Size      int64
+	Phase     PullPhase
+}
+
+// ProgressSink receives PullProgressEvents as a pull proceeds. Send must not
+// block; puller calls it synchronously from the pull path.
+type ProgressSink interface {
+	Send(PullProgressEvent)
+}
+
+// ProgressSinkFunc adapts a function to a ProgressSink.
+type ProgressSinkFunc func(PullProgressEvent)
+
+// Send implements ProgressSink.
+func (f ProgressSinkFunc) Send(ev PullProgressEvent) { f(ev) }
+
+// sendProgress emits a PullProgressEvent for desc if a ProgressSink is
+// configured; it's a no-op otherwise.
+func (p *puller) sendProgress(desc specs.Descriptor, phase PullPhase) {
+	if p.ProgressSink == nil {
+		return
+	}
+	p.ProgressSink.Send(PullProgressEvent{
+		Digest:    desc.Digest,
+		MediaType: desc.MediaType,
+		Size:      desc.Size,
+		Phase:     phase,
+	})
+}
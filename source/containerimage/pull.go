@@ -5,10 +5,12 @@ import (
 	"encoding/json"
 	"runtime"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/containerd/containerd/content"
 	"github.com/containerd/containerd/diff"
+	"github.com/containerd/containerd/gc"
 	"github.com/containerd/containerd/images"
 	"github.com/containerd/containerd/leases"
 	"github.com/containerd/containerd/platforms"
@@ -20,6 +22,7 @@ import (
 	"github.com/moby/buildkit/snapshot"
 	"github.com/moby/buildkit/solver"
 	"github.com/moby/buildkit/source"
+	"github.com/moby/buildkit/util/bklog"
 	"github.com/moby/buildkit/util/flightcontrol"
 	"github.com/moby/buildkit/util/imageutil"
 	"github.com/moby/buildkit/util/leaseutil"
@@ -44,11 +47,30 @@ type SourceOpt struct {
 	ImageStore    images.Store // optional
 	RegistryHosts docker.RegistryHosts
 	LeaseManager  leases.Manager
+	// GarbageCollect is called opportunistically by the puller after releasing
+	// temporary leases so that content orphaned by a failed or partial pull is
+	// reclaimed promptly instead of waiting for the next scheduled GC. It is
+	// safe to leave nil.
+	GarbageCollect func(ctx context.Context) (gc.Stats, error)
+	// EnableSchema1 allows pulling from registries that still serve Docker
+	// Schema 1 manifests by converting them to OCI/v2s2 on the fly. Off by
+	// default since it costs every pull an extra resolve round-trip.
+	EnableSchema1 bool
+	// LayerDownloadManager, if set, coordinates concurrent layer blob
+	// fetches across builds sharing this SourceOpt so that two builds
+	// referencing the same base image don't each trigger a full download.
+	// Safe to leave nil.
+	LayerDownloadManager *LayerDownloadManager
+	// ProgressSink, if set, receives structured per-descriptor pull progress
+	// events in addition to the vertex-level progress.Writer sourced from
+	// progress.FromContext. Safe to leave nil.
+	ProgressSink ProgressSink
 }
 
 type Source struct {
 	SourceOpt
-	g flightcontrol.Group
+	g             flightcontrol.Group
+	manifestCache *manifestCache
 }
 
 var _ source.Source = &Source{}
@@ -57,6 +79,9 @@ func NewSource(opt SourceOpt) (*Source, error) {
 	is := &Source{
 		SourceOpt: opt,
 	}
+	if opt.ContentStore != nil && opt.LeaseManager != nil {
+		is.manifestCache = newManifestCache(opt.ContentStore, opt.LeaseManager)
+	}
 
 	return is, nil
 }
@@ -80,6 +105,16 @@ func (is *Source) ResolveImageConfig(ctx context.Context, ref string, opt llb.Re
 		return "", nil, err
 	}
 
+	if is.manifestCache != nil && rm != source.ResolveModeForcePull {
+		if manifestDigest, ok := is.manifestCache.get(ctx, key); ok {
+			if configDigest, ok := is.manifestCache.getConfigDigest(ctx, manifestDigest); ok {
+				if dt, err := is.manifestCache.load(ctx, configDigest); err == nil {
+					return manifestDigest, dt, nil
+				}
+			}
+		}
+	}
+
 	res, err := is.g.Do(ctx, key, func(ctx context.Context) (interface{}, error) {
 		dgst, dt, err := imageutil.Config(ctx, ref, pull.NewResolver(g, pull.ResolverOpt{
 			Hosts:      is.RegistryHosts,
@@ -91,6 +126,16 @@ func (is *Source) ResolveImageConfig(ctx context.Context, ref string, opt llb.Re
 		if err != nil {
 			return nil, err
 		}
+		if is.manifestCache != nil {
+			configDigest, cerr := is.manifestCache.writeBlob(ctx, dt, specs.MediaTypeImageConfig)
+			if cerr != nil {
+				bklog.G(ctx).Warnf("failed to cache image config for %s: %v", ref, cerr)
+			} else if cerr := is.manifestCache.putConfigDigest(ctx, dgst, configDigest); cerr != nil {
+				bklog.G(ctx).Warnf("failed to link cached config for %s: %v", ref, cerr)
+			} else if cerr := is.manifestCache.put(ctx, key, dgst, rm == source.ResolveModePreferLocal); cerr != nil {
+				bklog.G(ctx).Warnf("failed to cache resolved digest for %s: %v", ref, cerr)
+			}
+		}
 		return &t{dgst: dgst, dt: dt}, nil
 	})
 	if err != nil {
@@ -117,10 +162,15 @@ func (is *Source) Resolve(ctx context.Context, id source.Identifier, sm *session
 		Src:          imageIdentifier.Reference,
 	}
 	p := &puller{
-		CacheAccessor: is.CacheAccessor,
-		LeaseManager:  is.LeaseManager,
-		Puller:        pullerUtil,
-		id:            imageIdentifier,
+		CacheAccessor:        is.CacheAccessor,
+		LeaseManager:         is.LeaseManager,
+		Puller:               pullerUtil,
+		id:                   imageIdentifier,
+		GarbageCollect:       is.GarbageCollect,
+		EnableSchema1:        is.EnableSchema1,
+		LayerDownloadManager: is.LayerDownloadManager,
+		ProgressSink:         is.ProgressSink,
+		manifestCache:        is.manifestCache,
 		ResolverOpt: pull.ResolverOpt{
 			Hosts:      is.RegistryHosts,
 			Auth:       resolver.NewSessionAuthenticator(sm, nil),
@@ -134,11 +184,16 @@ func (is *Source) Resolve(ctx context.Context, id source.Identifier, sm *session
 }
 
 type puller struct {
-	CacheAccessor cache.Accessor
-	LeaseManager  leases.Manager
-	ResolverOpt   pull.ResolverOpt
-	id            *source.ImageIdentifier
-	vtx           solver.Vertex
+	CacheAccessor        cache.Accessor
+	LeaseManager         leases.Manager
+	ResolverOpt          pull.ResolverOpt
+	id                   *source.ImageIdentifier
+	vtx                  solver.Vertex
+	GarbageCollect       func(ctx context.Context) (gc.Stats, error)
+	EnableSchema1        bool
+	LayerDownloadManager *LayerDownloadManager
+	ProgressSink         ProgressSink
+	manifestCache        *manifestCache
 
 	cacheKeyOnce     sync.Once
 	cacheKeyErr      error
@@ -147,6 +202,7 @@ type puller struct {
 	manifest         *pull.PulledManifests
 	manifestKey      string
 	configKey        string
+	gcInFlight       int32
 	*pull.Puller
 }
 
@@ -190,6 +246,7 @@ func (p *puller) CacheKey(ctx context.Context, g session.Group, index int) (cach
 		defer func() {
 			if p.cacheKeyErr != nil {
 				p.releaseTmpLeases(ctx)
+				p.garbageCollect(ctx)
 			}
 		}()
 
@@ -198,6 +255,11 @@ func (p *puller) CacheKey(ctx context.Context, g session.Group, index int) (cach
 			resolveProgressDone(err)
 		}()
 
+		if err = p.maybeConvertSchema1(ctx); err != nil {
+			p.cacheKeyErr = err
+			return
+		}
+
 		p.manifest, err = p.PullManifests(ctx)
 		if err != nil {
 			p.cacheKeyErr = err
@@ -214,8 +276,13 @@ func (p *puller) CacheKey(ctx context.Context, g session.Group, index int) (cach
 				progressController.Name = p.vtx.Name()
 			}
 
+			provider := p.manifest.Remote.Provider
+			if p.LayerDownloadManager != nil {
+				provider = p.LayerDownloadManager.Provider(provider)
+			}
+
 			descHandler := &cache.DescHandler{
-				Provider: p.manifest.Remote.Provider,
+				Provider: provider,
 				ImageRef: p.manifest.Ref,
 				Progress: progressController,
 			}
@@ -234,12 +301,18 @@ func (p *puller) CacheKey(ctx context.Context, g session.Group, index int) (cach
 		}
 		p.manifestKey = k.String()
 
+		p.sendProgress(p.manifest.ConfigDesc, PullPhaseDownloading)
 		dt, err := content.ReadBlob(ctx, p.ContentStore, p.manifest.ConfigDesc)
 		if err != nil {
 			p.cacheKeyErr = err
 			return
 		}
+		p.sendProgress(p.manifest.ConfigDesc, PullPhaseComplete)
 		p.configKey = cacheKeyFromConfig(dt).String()
+
+		if p.manifestCache != nil {
+			p.cacheResolvedManifest(ctx, desc.Digest)
+		}
 	})
 	if p.cacheKeyErr != nil {
 		return "", nil, false, p.cacheKeyErr
@@ -257,6 +330,32 @@ func (p *puller) CacheKey(ctx context.Context, g session.Group, index int) (cach
 	return p.configKey, cacheOpts, cacheDone, nil
 }
 
+// cacheResolvedManifest persists the manifest (and, if p.manifest came from a
+// manifest list, the list itself) alongside the config blob ResolveImageConfig
+// already caches, and links ref -> manifestDigest -> configDigest the same
+// way, so a later ResolveImageConfig for the same ref/platform can be answered
+// from the cache. CacheKey itself does not consult the cache and always calls
+// PullManifests. Failures are logged and otherwise
+// ignored: the cache is a best-effort speedup, not required for correctness.
+func (p *puller) cacheResolvedManifest(ctx context.Context, manifestDigest digest.Digest) {
+	for _, nl := range p.manifest.Nonlayers {
+		if err := p.manifestCache.pin(ctx, nl.Digest); err != nil {
+			bklog.G(ctx).Warnf("failed to pin %s in manifest cache: %v", nl.Digest, err)
+		}
+	}
+	if err := p.manifestCache.putConfigDigest(ctx, manifestDigest, p.manifest.ConfigDesc.Digest); err != nil {
+		bklog.G(ctx).Warnf("failed to link cached config for %s: %v", p.Src.String(), err)
+		return
+	}
+	key := p.Src.String()
+	if p.Platform != nil {
+		key += platforms.Format(*p.Platform)
+	}
+	if err := p.manifestCache.put(ctx, key, manifestDigest, p.ResolverOpt.Mode == source.ResolveModePreferLocal); err != nil {
+		bklog.G(ctx).Warnf("failed to cache resolved digest for %s: %v", p.Src.String(), err)
+	}
+}
+
 func (p *puller) Snapshot(ctx context.Context, g session.Group) (ir cache.ImmutableRef, err error) {
 	if p.Puller.Resolver == nil {
 		p.Puller.Resolver = pull.NewResolver(g, p.ResolverOpt)
@@ -267,6 +366,10 @@ func (p *puller) Snapshot(ctx context.Context, g session.Group) (ir cache.Immuta
 	if len(p.manifest.Remote.Descriptors) == 0 {
 		return nil, nil
 	}
+	// releaseTmpLeases must run before garbageCollect, or the content it just
+	// unpinned won't be collectible yet; defers run LIFO, so releaseTmpLeases
+	// is registered second to run first.
+	defer p.garbageCollect(ctx)
 	defer p.releaseTmpLeases(ctx)
 
 	var current cache.ImmutableRef
@@ -278,6 +381,7 @@ func (p *puller) Snapshot(ctx context.Context, g session.Group) (ir cache.Immuta
 
 	var parent cache.ImmutableRef
 	for _, layerDesc := range p.manifest.Remote.Descriptors {
+		p.sendProgress(layerDesc, PullPhaseDownloading)
 		parent = current
 		current, err = p.CacheAccessor.GetByBlob(ctx, layerDesc, parent, p.descHandlers)
 		if parent != nil {
@@ -286,6 +390,7 @@ func (p *puller) Snapshot(ctx context.Context, g session.Group) (ir cache.Immuta
 		if err != nil {
 			return nil, err
 		}
+		p.sendProgress(layerDesc, PullPhaseComplete)
 	}
 
 	for _, desc := range p.manifest.Nonlayers {
@@ -351,6 +456,48 @@ func cacheKeyFromConfig(dt []byte) digest.Digest {
 	return identity.ChainID(img.RootFS.DiffIDs)
 }
 
+// garbageCollect runs p.GarbageCollect, if set, on a best-effort basis. It is
+// triggered after temporary leases are released so that content left behind
+// by a failed pull (or orphaned once a Snapshot has converted descriptors
+// into cache refs) doesn't accumulate until the next scheduled GC sweep.
+//
+// The sweep itself runs in the background on a context detached from ctx's
+// cancellation: ctx is frequently already cancelled or past its deadline by
+// the time this is called (the most common trigger is a failed/cancelled
+// pull), and a GC invoked with a dead context would return immediately
+// without reclaiming anything, exactly when there's cleanup to do. Running
+// it asynchronously also keeps a typically-global-locking GC sweep off the
+// hot path of every successful Snapshot. Sweeps are throttled to one at a
+// time per puller; a request that arrives while one is already running is
+// dropped, since the next trigger will cover whatever it would have found.
+func (p *puller) garbageCollect(ctx context.Context) {
+	if p.GarbageCollect == nil {
+		return
+	}
+	if !atomic.CompareAndSwapInt32(&p.gcInFlight, 0, 1) {
+		return
+	}
+	go func() {
+		defer atomic.StoreInt32(&p.gcInFlight, 0)
+		gcCtx, cancel := context.WithTimeout(detachedContext{ctx}, 30*time.Second)
+		defer cancel()
+		if _, err := p.GarbageCollect(gcCtx); err != nil {
+			bklog.G(ctx).Errorf("gc error after pulling %s: %v", p.Src.String(), err)
+		}
+	}()
+}
+
+// detachedContext wraps a context to keep its values (logger, trace span,
+// etc.) while dropping its cancellation and deadline, so background work
+// triggered by a request isn't cancelled along with it.
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
+
 func oneOffProgress(ctx context.Context, id string) func(err error) error {
 	pw, _, _ := progress.FromContext(ctx)
 	now := time.Now()
@@ -0,0 +1,229 @@
+package containerimage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/remotes"
+	digest "github.com/opencontainers/go-digest"
+	ocispecs "github.com/opencontainers/image-spec/specs-go"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+const (
+	mediaTypeDockerSchema1Manifest       = "application/vnd.docker.distribution.manifest.v1+json"
+	mediaTypeDockerSchema1ManifestSigned = "application/vnd.docker.distribution.manifest.v1+prettyjws"
+)
+
+func isSchema1(mediaType string) bool {
+	return mediaType == mediaTypeDockerSchema1Manifest || mediaType == mediaTypeDockerSchema1ManifestSigned
+}
+
+// schema1Manifest is the subset of a Docker Schema 1 manifest needed to
+// synthesize a v2s2 manifest and image config.
+type schema1Manifest struct {
+	FSLayers []struct {
+		BlobSum digest.Digest `json:"blobSum"`
+	} `json:"fsLayers"`
+	History []struct {
+		V1Compatibility string `json:"v1Compatibility"`
+	} `json:"history"`
+}
+
+// schema1V1Compatibility is the per-history-entry JSON embedded in a schema1
+// manifest; only the fields needed to reconstruct an image config are kept.
+type schema1V1Compatibility struct {
+	Architecture string          `json:"architecture,omitempty"`
+	OS           string          `json:"os,omitempty"`
+	Config       json.RawMessage `json:"config,omitempty"`
+}
+
+// pinnedResolver wraps a remotes.Resolver so ref always resolves to desc
+// instead of re-querying the registry, while every other ref (and Fetcher /
+// Pusher) still falls through to the embedded Resolver. It's used to splice
+// a schema1-converted manifest back into the normal resolve/pull path.
+type pinnedResolver struct {
+	remotes.Resolver
+	ref  string
+	desc specs.Descriptor
+}
+
+func (r *pinnedResolver) Resolve(ctx context.Context, ref string) (string, specs.Descriptor, error) {
+	if ref == r.ref {
+		return ref, r.desc, nil
+	}
+	return r.Resolver.Resolve(ctx, ref)
+}
+
+// maybeConvertSchema1 resolves p.Src to inspect its media type, and if it is
+// a Docker Schema 1 manifest, synthesizes an OCI/v2s2 manifest and config in
+// the content store and repoints p.Puller.Resolver at the synthesized
+// digest so PullManifests continues exactly as if the registry had returned
+// v2s2.
+//
+// This performs its own Resolve call ahead of the one PullManifests makes
+// internally, so it's opt-in via SourceOpt.EnableSchema1 rather than
+// unconditional: schema1 is only still served by ancient private registries,
+// and every other puller would otherwise pay for an extra round-trip it
+// doesn't need.
+func (p *puller) maybeConvertSchema1(ctx context.Context) error {
+	if !p.EnableSchema1 {
+		return nil
+	}
+
+	ref := p.Src.String()
+	_, desc, err := p.Puller.Resolver.Resolve(ctx, ref)
+	if err != nil {
+		// Let PullManifests below surface the real resolve error.
+		return nil
+	}
+	if !isSchema1(desc.MediaType) {
+		return nil
+	}
+
+	fetcher, err := p.Puller.Resolver.Fetcher(ctx, ref)
+	if err != nil {
+		return errors.Wrap(err, "creating fetcher for schema1 manifest")
+	}
+
+	converted, err := convertSchema1(ctx, fetcher, p.ContentStore, desc)
+	if err != nil {
+		return errors.Wrap(err, "converting schema1 manifest")
+	}
+
+	p.Puller.Resolver = &pinnedResolver{Resolver: p.Puller.Resolver, ref: ref, desc: converted}
+	return nil
+}
+
+// convertSchema1 fetches and parses the Docker Schema 1 manifest at desc,
+// synthesizes an OCI image config and a v2s2 manifest from its
+// fsLayers/history (the gzip layer digests stand in for diff_ids, since
+// schema1 carries no uncompressed digest, and the image config is
+// reconstructed from the v1Compatibility JSON of the topmost history entry),
+// writes both to store, and returns a descriptor for the synthesized
+// manifest.
+//
+// convertSchema1 runs ahead of PullManifests (see maybeConvertSchema1), so
+// the layer blobs it references aren't in store yet on a fresh pull; layer
+// sizes are determined with fetchBlobSize rather than store.Info.
+func convertSchema1(ctx context.Context, fetcher remotes.Fetcher, store content.Store, desc specs.Descriptor) (specs.Descriptor, error) {
+	rc, err := fetcher.Fetch(ctx, desc)
+	if err != nil {
+		return specs.Descriptor{}, errors.Wrap(err, "fetching schema1 manifest")
+	}
+	defer rc.Close()
+
+	dt, err := io.ReadAll(rc)
+	if err != nil {
+		return specs.Descriptor{}, errors.Wrap(err, "reading schema1 manifest")
+	}
+	if desc.MediaType == mediaTypeDockerSchema1ManifestSigned {
+		dt = stripJWS(dt)
+	}
+
+	var m schema1Manifest
+	if err := json.Unmarshal(dt, &m); err != nil {
+		return specs.Descriptor{}, errors.Wrap(err, "unmarshalling schema1 manifest")
+	}
+	if len(m.History) == 0 || len(m.History) != len(m.FSLayers) {
+		return specs.Descriptor{}, errors.New("schema1 manifest has mismatched fsLayers/history")
+	}
+
+	var top schema1V1Compatibility
+	if err := json.Unmarshal([]byte(m.History[0].V1Compatibility), &top); err != nil {
+		return specs.Descriptor{}, errors.Wrap(err, "unmarshalling schema1 v1Compatibility")
+	}
+
+	// fsLayers/history are ordered top (most recent) to bottom (base image);
+	// OCI configs and manifests expect base-to-top order.
+	diffIDs := make([]digest.Digest, len(m.FSLayers))
+	layers := make([]specs.Descriptor, len(m.FSLayers))
+	for i, fl := range m.FSLayers {
+		size, err := fetchBlobSize(ctx, fetcher, fl.BlobSum)
+		if err != nil {
+			return specs.Descriptor{}, errors.Wrapf(err, "sizing layer %s referenced by schema1 manifest", fl.BlobSum)
+		}
+		j := len(m.FSLayers) - 1 - i
+		diffIDs[j] = fl.BlobSum
+		layers[j] = specs.Descriptor{
+			MediaType: images.MediaTypeDockerSchema2LayerGzip,
+			Digest:    fl.BlobSum,
+			Size:      size,
+		}
+	}
+
+	var img specs.Image
+	img.Architecture = top.Architecture
+	img.OS = top.OS
+	img.RootFS.Type = "layers"
+	img.RootFS.DiffIDs = diffIDs
+	if len(top.Config) > 0 {
+		if err := json.Unmarshal(top.Config, &img.Config); err != nil {
+			return specs.Descriptor{}, errors.Wrap(err, "unmarshalling schema1 container config")
+		}
+	}
+
+	configDesc, err := writeSynthesizedBlob(ctx, store, img, specs.MediaTypeImageConfig)
+	if err != nil {
+		return specs.Descriptor{}, errors.Wrap(err, "writing synthesized image config")
+	}
+
+	manifest := specs.Manifest{
+		Versioned: ocispecs.Versioned{SchemaVersion: 2},
+		MediaType: images.MediaTypeDockerSchema2Manifest,
+		Config:    configDesc,
+		Layers:    layers,
+	}
+	manifestDesc, err := writeSynthesizedBlob(ctx, store, manifest, images.MediaTypeDockerSchema2Manifest)
+	if err != nil {
+		return specs.Descriptor{}, errors.Wrap(err, "writing synthesized v2s2 manifest")
+	}
+
+	return manifestDesc, nil
+}
+
+// fetchBlobSize returns the size of the blob dgst by fetching it and
+// counting its bytes. It's used instead of a content-store lookup for blobs
+// (e.g. schema1 layers) that convertSchema1 needs to size before they've
+// been pulled into the local store.
+func fetchBlobSize(ctx context.Context, fetcher remotes.Fetcher, dgst digest.Digest) (int64, error) {
+	rc, err := fetcher.Fetch(ctx, specs.Descriptor{Digest: dgst})
+	if err != nil {
+		return 0, err
+	}
+	defer rc.Close()
+	return io.Copy(io.Discard, rc)
+}
+
+// stripJWS drops anything that follows the manifest JSON object's last
+// closing brace. The "signatures" member that a pretty-JWS manifest carries
+// inside the object is left in place; unmarshalling into schema1Manifest
+// ignores it.
+func stripJWS(dt []byte) []byte {
+	if idx := bytes.LastIndexByte(dt, '}'); idx >= 0 {
+		return dt[:idx+1]
+	}
+	return dt
+}
+
+func writeSynthesizedBlob(ctx context.Context, store content.Store, v interface{}, mediaType string) (specs.Descriptor, error) {
+	dt, err := json.Marshal(v)
+	if err != nil {
+		return specs.Descriptor{}, err
+	}
+	desc := specs.Descriptor{
+		MediaType: mediaType,
+		Digest:    digest.FromBytes(dt),
+		Size:      int64(len(dt)),
+	}
+	if err := content.WriteBlob(ctx, store, desc.Digest.String(), bytes.NewReader(dt), desc); err != nil && !errdefs.IsAlreadyExists(err) {
+		return specs.Descriptor{}, err
+	}
+	return desc, nil
+}